@@ -0,0 +1,258 @@
+package queryrange
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/ipc"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+	"github.com/grafana/dskit/httpgrpc"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/grafana/loki/pkg/loghttp"
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/logql/syntax"
+	"github.com/grafana/loki/pkg/querier/queryrange/queryrangebase"
+)
+
+// ArrowType is the Accept/Content-Type value that opts a range query into the columnar
+// encoding below instead of JSON or ProtobufType. It mirrors the vendor-specific naming
+// already used for ProtobufType (application/vnd.google.protobuf).
+const ArrowType = "application/vnd.apache.arrow.stream"
+
+// arrowSchema lays out one RecordBatch column per label key present across the streams
+// being encoded, in addition to the fixed timestamp/line columns. Label columns are
+// dictionary-encoded since label values repeat heavily within a single stream.
+func arrowSchema(labelKeys []string) *arrow.Schema {
+	fields := make([]arrow.Field, 0, len(labelKeys)+2)
+	fields = append(fields,
+		arrow.Field{Name: "timestamp", Type: arrow.FixedWidthTypes.Timestamp_ns},
+		arrow.Field{Name: "line", Type: arrow.BinaryTypes.LargeString},
+	)
+	for _, key := range labelKeys {
+		fields = append(fields, arrow.Field{
+			Name:     key,
+			Type:     &arrow.DictionaryType{IndexType: arrow.PrimitiveTypes.Int32, ValueType: arrow.BinaryTypes.String},
+			Nullable: true,
+		})
+	}
+	return arrow.NewSchema(fields, nil)
+}
+
+// encodeResponseArrow writes a *LokiResponse as a single Arrow RecordBatch, with one row
+// per log entry across all streams. EncodeResponse calls this for any response whose
+// request asked for ArrowType; any type other than *LokiResponse gets an error.
+func encodeResponseArrow(ctx context.Context, res queryrangebase.Response) (*http.Response, error) {
+	sp, _ := opentracing.StartSpanFromContext(ctx, "codec.EncodeResponse")
+	defer sp.Finish()
+
+	response, ok := res.(*LokiResponse)
+	if !ok {
+		return nil, httpgrpc.Errorf(http.StatusInternalServerError, "arrow encoding only supports streams responses, got (%T)", res)
+	}
+
+	// response.ArrowEncoded is only ever set by decodeResponseArrow, for a response
+	// that passed straight through without being merged with any other shard; reuse
+	// those raw bytes rather than re-marshalling Data.Result for nothing. A merged
+	// response never has ArrowEncoded set (mergeLokiResponse doesn't produce it), so
+	// this always falls through to marshalArrow for anything that was actually merged.
+	var buf *bytes.Buffer
+	if len(response.ArrowEncoded) > 0 {
+		buf = bytes.NewBuffer(response.ArrowEncoded)
+	} else {
+		var err error
+		buf, err = marshalArrow(response.Data.Result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sp.LogFields(otlog.Int("bytes", buf.Len()))
+
+	resp := http.Response{
+		Header: http.Header{
+			"Content-Type": []string{ArrowType},
+		},
+		Body:       io.NopCloser(buf),
+		StatusCode: http.StatusOK,
+	}
+	return &resp, nil
+}
+
+// marshalArrow builds the RecordBatch for a set of streams and returns it IPC-stream
+// encoded, ready to write straight to an http.ResponseWriter.
+func marshalArrow(streams []logproto.Stream) (*bytes.Buffer, error) {
+	labelKeys := collectLabelKeys(streams)
+	schema := arrowSchema(labelKeys)
+
+	pool := memory.NewGoAllocator()
+	b := array.NewRecordBuilder(pool, schema)
+	defer b.Release()
+
+	tsBuilder := b.Field(0).(*array.TimestampBuilder)
+	lineBuilder := b.Field(1).(*array.LargeStringBuilder)
+	labelBuilders := make([]*array.BinaryDictionaryBuilder, len(labelKeys))
+	for i := range labelKeys {
+		labelBuilders[i] = b.Field(i + 2).(*array.BinaryDictionaryBuilder)
+	}
+
+	for _, stream := range streams {
+		labelSet, err := syntax.ParseLabels(stream.Labels)
+		if err != nil {
+			// fall back to an empty label set (every label column is null for these
+			// rows) rather than dropping the stream entirely.
+			labelSet = labels.Labels{}
+		}
+		for _, entry := range stream.Entries {
+			tsBuilder.Append(arrow.Timestamp(entry.Timestamp.UnixNano()))
+			lineBuilder.Append(entry.Line)
+			for i, key := range labelKeys {
+				if v, ok := lookupLabel(labelSet, key); ok {
+					if err := labelBuilders[i].AppendString(v); err != nil {
+						return nil, err
+					}
+				} else {
+					labelBuilders[i].AppendNull()
+				}
+			}
+		}
+	}
+
+	record := b.NewRecord()
+	defer record.Release()
+
+	var buf bytes.Buffer
+	w := ipc.NewWriter(&buf, ipc.WithSchema(schema))
+	if err := w.Write(record); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// collectLabelKeys gathers every distinct label key across streams so the RecordBatch
+// schema can be built up front; Arrow requires a fixed column set per batch.
+func collectLabelKeys(streams []logproto.Stream) []string {
+	seen := make(map[string]struct{})
+	for _, stream := range streams {
+		labelSet, err := syntax.ParseLabels(stream.Labels)
+		if err != nil {
+			continue
+		}
+		for _, l := range labelSet {
+			seen[l.Name] = struct{}{}
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func lookupLabel(labelSet labels.Labels, key string) (string, bool) {
+	for _, l := range labelSet {
+		if l.Name == key {
+			return l.Value, true
+		}
+	}
+	return "", false
+}
+
+// decodeResponseArrow reads an IPC-stream-encoded RecordBatch back into a *LokiResponse.
+// Rows are grouped back into streams by their label column values, which is the inverse
+// of marshalArrow flattening streams into rows. The raw bytes are kept on the returned
+// response's ArrowEncoded field so that encodeResponseArrow can pass them straight
+// through again if this particular response is never merged with another shard.
+func decodeResponseArrow(r io.Reader, req queryrangebase.Request) (queryrangebase.Response, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := memory.NewGoAllocator()
+	reader, err := ipc.NewReader(bytes.NewReader(raw), ipc.WithAllocator(pool))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Release()
+
+	byLabels := make(map[string]*logproto.Stream)
+	var order []string
+
+	for reader.Next() {
+		rec := reader.Record()
+		labelCols := rec.Schema().Fields()[2:]
+
+		tsCol := rec.Column(0).(*array.Timestamp)
+		lineCol := rec.Column(1).(*array.LargeString)
+
+		for row := 0; row < int(rec.NumRows()); row++ {
+			var b strings.Builder
+			b.WriteByte('{')
+			wrote := false
+			for i, f := range labelCols {
+				col := rec.Column(i + 2).(*array.Dictionary)
+				if col.IsNull(row) {
+					continue
+				}
+				if wrote {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(&b, "%s=%q", f.Name, col.Dictionary().(*array.String).Value(col.GetValueIndex(row)))
+				wrote = true
+			}
+			b.WriteByte('}')
+			key := b.String()
+
+			stream, ok := byLabels[key]
+			if !ok {
+				stream = &logproto.Stream{Labels: key}
+				byLabels[key] = stream
+				order = append(order, key)
+			}
+			stream.Entries = append(stream.Entries, logproto.Entry{
+				Timestamp: time.Unix(0, int64(tsCol.Value(row))).UTC(),
+				Line:      lineCol.Value(row),
+			})
+		}
+	}
+	if err := reader.Err(); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	lokiReq, ok := req.(*LokiRequest)
+	if !ok {
+		return nil, fmt.Errorf("arrow decoding only supports range query requests, got (%T)", req)
+	}
+
+	result := make([]logproto.Stream, 0, len(order))
+	for _, key := range order {
+		result = append(result, *byLabels[key])
+	}
+
+	return &LokiResponse{
+		Status:       loghttp.QueryStatusSuccess,
+		Direction:    lokiReq.Direction,
+		Limit:        lokiReq.Limit,
+		Version:      uint32(loghttp.GetVersion(lokiReq.Path)),
+		ArrowEncoded: raw,
+		Data: LokiData{
+			ResultType: loghttp.ResultTypeStream,
+			Result:     result,
+		},
+	}, nil
+}
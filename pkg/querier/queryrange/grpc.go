@@ -0,0 +1,211 @@
+package queryrange
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/dskit/httpgrpc"
+	json "github.com/json-iterator/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/querier/queryrange/queryrangebase"
+)
+
+// QueryRangeServiceServer is the gRPC counterpart to the HTTP Codec: intermediate
+// frontends fan out to peer frontends/schedulers over this instead of paying HTTP
+// framing plus JSON/proto marshalling on top of an already-proto QueryResponse.
+type QueryRangeServiceServer interface {
+	Do(context.Context, *QueryResponseRequest) (*QueryResponse, error)
+}
+
+// QueryRangeServiceClient is the client side of QueryRangeServiceServer, used by a
+// frontend to fan a request out to a peer over gRPC.
+type QueryRangeServiceClient interface {
+	Do(ctx context.Context, in *QueryResponseRequest, opts ...grpc.CallOption) (*QueryResponse, error)
+}
+
+// QueryResponseRequest wraps one of the request types handled by ParamsFromRequest
+// (LokiRequest, LokiInstantRequest, LokiSeriesRequest, LabelRequest, IndexStatsRequest,
+// VolumeRequest) so it can cross the wire as a single gRPC message, mirroring the
+// oneof layout of QueryResponse itself.
+type QueryResponseRequest struct {
+	Range    *LokiRequest               `protobuf:"bytes,1,opt,name=range"`
+	Instant  *LokiInstantRequest        `protobuf:"bytes,2,opt,name=instant"`
+	Series   *LokiSeriesRequest         `protobuf:"bytes,3,opt,name=series"`
+	Label    *logproto.LabelRequest     `protobuf:"bytes,4,opt,name=label"`
+	Stats    *logproto.IndexStatsRequest `protobuf:"bytes,5,opt,name=stats"`
+	Volume   *logproto.VolumeRequest    `protobuf:"bytes,6,opt,name=volume"`
+	LabelPath string                    `protobuf:"bytes,7,opt,name=label_path"`
+}
+
+// AsRequest unwraps the populated oneof-style field back into a queryrangebase.Request.
+func (m *QueryResponseRequest) AsRequest() (queryrangebase.Request, error) {
+	switch {
+	case m.Range != nil:
+		return m.Range, nil
+	case m.Instant != nil:
+		return m.Instant, nil
+	case m.Series != nil:
+		return m.Series, nil
+	case m.Label != nil:
+		return &LabelRequest{LabelRequest: *m.Label, path: m.LabelPath}, nil
+	case m.Stats != nil:
+		return m.Stats, nil
+	case m.Volume != nil:
+		return m.Volume, nil
+	default:
+		return nil, fmt.Errorf("empty QueryResponseRequest")
+	}
+}
+
+// QueryResponseRequestFrom builds the wire message for a decoded request, the inverse
+// of AsRequest.
+func QueryResponseRequestFrom(r queryrangebase.Request) (*QueryResponseRequest, error) {
+	switch req := r.(type) {
+	case *LokiRequest:
+		return &QueryResponseRequest{Range: req}, nil
+	case *LokiInstantRequest:
+		return &QueryResponseRequest{Instant: req}, nil
+	case *LokiSeriesRequest:
+		return &QueryResponseRequest{Series: req}, nil
+	case *LabelRequest:
+		return &QueryResponseRequest{Label: req.AsProto(), LabelPath: req.Path()}, nil
+	case *logproto.IndexStatsRequest:
+		return &QueryResponseRequest{Stats: req}, nil
+	case *logproto.VolumeRequest:
+		return &QueryResponseRequest{Volume: req}, nil
+	default:
+		return nil, fmt.Errorf("invalid request format, got (%T)", r)
+	}
+}
+
+// GRPCCodec selects the gRPC transport: middlewares that would otherwise call
+// Codec.EncodeResponse/DecodeResponse over HTTP can instead hand requests/responses
+// directly to a QueryRangeServiceClient and skip HTTP framing and JSON entirely.
+type GRPCCodec struct {
+	Codec
+}
+
+// grpcQueryRangeServer adapts the existing middleware stack (a queryrangebase.Handler)
+// so a single handler implementation serves both the HTTP and gRPC transports.
+type grpcQueryRangeServer struct {
+	next queryrangebase.Handler
+}
+
+// NewGRPCQueryRangeServer wraps a queryrangebase.Handler (the composed middleware
+// stack already used by the HTTP path) as a QueryRangeServiceServer.
+func NewGRPCQueryRangeServer(next queryrangebase.Handler) QueryRangeServiceServer {
+	return &grpcQueryRangeServer{next: next}
+}
+
+func (s *grpcQueryRangeServer) Do(ctx context.Context, in *QueryResponseRequest) (*QueryResponse, error) {
+	req, err := in.AsRequest()
+	if err != nil {
+		return nil, httpgrpc.Errorf(400, err.Error())
+	}
+
+	res, err := s.next.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return QueryResponseWrap(res)
+}
+
+// jsonCodecName is the gRPC content-subtype QueryRangeServiceClient/Server negotiate,
+// distinguishing this transport's wire encoding from the default "proto" one that
+// neither QueryResponseRequest nor QueryResponse can satisfy (protoc never generated
+// Marshal/Unmarshal for them in this checkout; see QueryResponse's doc comment).
+const jsonCodecName = "json"
+
+// jsonCodec implements encoding.Codec by delegating to jsoniter, the same JSON
+// implementation EncodeRequest/DecodeResponse already use elsewhere in this package.
+// Registering it lets QueryRangeServiceServer/Client round-trip QueryResponseRequest
+// and QueryResponse over a real *grpc.Server/ClientConn without protoc-generated code.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return jsonCodecName
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// queryRangeServiceName is the gRPC service name QueryRangeServiceDesc is registered
+// under and queryRangeServiceClient dials, mirroring how a protoc-generated
+// *_grpc.pb.go would name it after this package's service.
+const queryRangeServiceName = "loki.querier.queryrange.QueryRangeService"
+
+// QueryRangeServiceDesc is the grpc.ServiceDesc a protoc-generated RegisterXxxServer
+// function would normally supply; written out by hand here since protoc isn't part of
+// this checkout. RegisterQueryRangeServiceServer passes it to grpc.Server.RegisterService.
+var QueryRangeServiceDesc = grpc.ServiceDesc{
+	ServiceName: queryRangeServiceName,
+	HandlerType: (*QueryRangeServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Do",
+			Handler:    queryRangeServiceDoHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "pkg/querier/queryrange/grpc.go",
+}
+
+func queryRangeServiceDoHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryResponseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueryRangeServiceServer).Do(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: queryRangeServiceName + "/Do",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueryRangeServiceServer).Do(ctx, req.(*QueryResponseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// RegisterQueryRangeServiceServer registers srv against s the way a protoc-generated
+// RegisterQueryRangeServiceServer would, so NewGRPCQueryRangeServer's result is
+// actually reachable over a *grpc.Server rather than left as unwired scaffolding.
+func RegisterQueryRangeServiceServer(s grpc.ServiceRegistrar, srv QueryRangeServiceServer) {
+	s.RegisterService(&QueryRangeServiceDesc, srv)
+}
+
+// queryRangeServiceClient implements QueryRangeServiceClient over a real
+// grpc.ClientConnInterface, negotiating jsonCodecName via grpc.CallContentSubtype so
+// the conn doesn't attempt the default proto codec against these non-proto messages.
+type queryRangeServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewQueryRangeServiceClient dials QueryRangeServiceServer over cc, mirroring the
+// NewXxxClient constructor a protoc-generated *_grpc.pb.go would provide.
+func NewQueryRangeServiceClient(cc grpc.ClientConnInterface) QueryRangeServiceClient {
+	return &queryRangeServiceClient{cc: cc}
+}
+
+func (c *queryRangeServiceClient) Do(ctx context.Context, in *QueryResponseRequest, opts ...grpc.CallOption) (*QueryResponse, error) {
+	out := new(QueryResponse)
+	opts = append(opts, grpc.CallContentSubtype(jsonCodecName))
+	if err := c.cc.Invoke(ctx, "/"+queryRangeServiceName+"/Do", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,233 @@
+package logqlcompliance
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/loki/pkg/loghttp"
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/querier/queryrange"
+	"github.com/grafana/loki/pkg/querier/queryrange/queryrangebase"
+)
+
+// epoch anchors every generated timestamp. Using a fixed base rather than time.Now
+// keeps a failing Result's Detail diff reproducible run to run.
+var epoch = time.Unix(1700000000, 0).UTC()
+
+func tsAt(seconds int) time.Time {
+	return epoch.Add(time.Duration(seconds) * time.Second)
+}
+
+// generate builds a synthetic pair of shard responses plus the reference response
+// they should merge into, for one (shape, scenario) combination. The two shards
+// always cover the same four (labels, timestamp, value/line) samples; only the
+// scenario changes how those samples are distributed and ordered across them.
+func generate(ctx context.Context, shape QueryShape, scenario Scenario) (shards []queryrangebase.Response, reference queryrangebase.Response, err error) {
+	if shape == ShapeLogQueryArrow {
+		s, ref := generateStreamShards(scenario)
+		arrowShards := make([]queryrangebase.Response, len(s))
+		for i, shard := range s {
+			rt, err := arrowRoundTrip(ctx, shard.(*queryrange.LokiResponse))
+			if err != nil {
+				return nil, nil, fmt.Errorf("arrow round-trip shard %d: %w", i, err)
+			}
+			arrowShards[i] = rt
+		}
+		return arrowShards, ref, nil
+	}
+	if isStreamShape(shape) {
+		s, ref := generateStreamShards(scenario)
+		return s, ref, nil
+	}
+	if _, ok := exampleQuery[shape]; !ok {
+		return nil, nil, fmt.Errorf("unknown query shape %q", shape)
+	}
+	s, ref := generateMetricShards(scenario)
+	return s, ref, nil
+}
+
+// arrowRoundTrip drives resp through Codec.EncodeResponse/DecodeResponse's Arrow path,
+// the way a real shard response would cross the wire under ArrowType, so
+// ShapeLogQueryArrow's shards are genuinely Arrow-encoded rather than merely tagged
+// as such.
+func arrowRoundTrip(ctx context.Context, resp *queryrange.LokiResponse) (*queryrange.LokiResponse, error) {
+	req := &queryrange.LokiRequest{
+		Direction: resp.Direction,
+		Limit:     resp.Limit,
+		Path:      "/loki/api/v1/query_range",
+	}
+
+	encodeReq, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+req.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+	encodeReq.Header.Set("Accept", queryrange.ArrowType)
+
+	httpResp, err := queryrange.DefaultCodec.EncodeResponse(ctx, encodeReq, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := queryrange.DefaultCodec.DecodeResponse(ctx, httpResp, req)
+	if err != nil {
+		return nil, err
+	}
+	lokiResp, ok := decoded.(*queryrange.LokiResponse)
+	if !ok {
+		return nil, fmt.Errorf("expected *LokiResponse from arrow round-trip, got %T", decoded)
+	}
+	return lokiResp, nil
+}
+
+// generateStreamShards builds two *LokiResponse shards -- and the *LokiResponse they
+// should merge into -- covering the same {app="foo"}/{app="bar"} streams laid out
+// according to scenario.
+func generateStreamShards(scenario Scenario) ([]queryrangebase.Response, queryrangebase.Response) {
+	fooEntries := []logproto.Entry{
+		{Timestamp: tsAt(0), Line: "foo line 0"},
+		{Timestamp: tsAt(10), Line: "foo line 1"},
+	}
+	barEntries := []logproto.Entry{
+		{Timestamp: tsAt(5), Line: "bar line 0"},
+		{Timestamp: tsAt(15), Line: "bar line 1"},
+	}
+
+	var shardA, shardB []logproto.Stream
+	switch scenario {
+	case ScenarioDisjoint, ScenarioShardError:
+		shardA = []logproto.Stream{
+			{Labels: `{app="foo"}`, Entries: fooEntries[:1]},
+			{Labels: `{app="bar"}`, Entries: barEntries[:1]},
+		}
+		shardB = []logproto.Stream{
+			{Labels: `{app="foo"}`, Entries: fooEntries[1:]},
+			{Labels: `{app="bar"}`, Entries: barEntries[1:]},
+		}
+	case ScenarioOverlapping:
+		// Shard B re-reports fooEntries[0] and barEntries[0], as a retried query
+		// against a different replica would.
+		shardA = []logproto.Stream{
+			{Labels: `{app="foo"}`, Entries: fooEntries},
+			{Labels: `{app="bar"}`, Entries: barEntries},
+		}
+		shardB = []logproto.Stream{
+			{Labels: `{app="foo"}`, Entries: fooEntries[:1]},
+			{Labels: `{app="bar"}`, Entries: barEntries[:1]},
+		}
+	case ScenarioOutOfOrder:
+		// Same split as the disjoint case, but shard B's stream entries arrive in
+		// the opposite order from how they'd be produced by a forward query.
+		shardA = []logproto.Stream{
+			{Labels: `{app="foo"}`, Entries: fooEntries[:1]},
+			{Labels: `{app="bar"}`, Entries: barEntries[:1]},
+		}
+		shardB = []logproto.Stream{
+			{Labels: `{app="bar"}`, Entries: barEntries[1:]},
+			{Labels: `{app="foo"}`, Entries: fooEntries[1:]},
+		}
+	}
+
+	newResp := func(data []logproto.Stream) *queryrange.LokiResponse {
+		return &queryrange.LokiResponse{
+			Status:    loghttp.QueryStatusSuccess,
+			Direction: logproto.FORWARD,
+			Limit:     100,
+			Version:   1,
+			Data: queryrange.LokiData{
+				ResultType: loghttp.ResultTypeStream,
+				Result:     data,
+			},
+		}
+	}
+
+	shards := []queryrangebase.Response{newResp(shardA), newResp(shardB)}
+	if scenario == ScenarioOutOfOrder {
+		// Feed the merger the shards in reverse arrival order too, since a
+		// time-ordered merge shouldn't depend on the order shards are supplied in.
+		shards = []queryrangebase.Response{newResp(shardB), newResp(shardA)}
+	}
+
+	reference := newResp([]logproto.Stream{
+		{Labels: `{app="bar"}`, Entries: barEntries},
+		{Labels: `{app="foo"}`, Entries: fooEntries},
+	})
+
+	return shards, reference
+}
+
+// generateMetricShards builds two *LokiPromResponse shards -- and the reference they
+// should merge into -- for the matrix/vector merge path shared by every non-log-query
+// shape (the merger doesn't distinguish rate() from count_over_time() etc.; it only
+// ever sees the resulting SampleStreams).
+func generateMetricShards(scenario Scenario) ([]queryrangebase.Response, queryrangebase.Response) {
+	fooLabels := []logproto.LabelAdapter{{Name: "app", Value: "foo"}}
+	barLabels := []logproto.LabelAdapter{{Name: "app", Value: "bar"}}
+
+	fooSamples := []logproto.LegacySample{
+		{TimestampMs: int64(0 * 1000), Value: 1},
+		{TimestampMs: int64(10 * 1000), Value: 2},
+	}
+	barSamples := []logproto.LegacySample{
+		{TimestampMs: int64(5 * 1000), Value: 3},
+		{TimestampMs: int64(15 * 1000), Value: 4},
+	}
+
+	var shardA, shardB []queryrangebase.SampleStream
+	switch scenario {
+	case ScenarioDisjoint, ScenarioShardError:
+		shardA = []queryrangebase.SampleStream{
+			{Labels: fooLabels, Samples: fooSamples[:1]},
+			{Labels: barLabels, Samples: barSamples[:1]},
+		}
+		shardB = []queryrangebase.SampleStream{
+			{Labels: fooLabels, Samples: fooSamples[1:]},
+			{Labels: barLabels, Samples: barSamples[1:]},
+		}
+	case ScenarioOverlapping:
+		// Shard B re-reports the same (label, timestamp) points as shard A; the
+		// merger should dedup rather than double-count them.
+		shardA = []queryrangebase.SampleStream{
+			{Labels: fooLabels, Samples: fooSamples},
+			{Labels: barLabels, Samples: barSamples},
+		}
+		shardB = []queryrangebase.SampleStream{
+			{Labels: fooLabels, Samples: fooSamples[:1]},
+			{Labels: barLabels, Samples: barSamples[:1]},
+		}
+	case ScenarioOutOfOrder:
+		shardA = []queryrangebase.SampleStream{
+			{Labels: fooLabels, Samples: fooSamples[:1]},
+			{Labels: barLabels, Samples: barSamples[:1]},
+		}
+		shardB = []queryrangebase.SampleStream{
+			{Labels: barLabels, Samples: barSamples[1:]},
+			{Labels: fooLabels, Samples: fooSamples[1:]},
+		}
+	}
+
+	newResp := func(result []queryrangebase.SampleStream) *queryrange.LokiPromResponse {
+		return &queryrange.LokiPromResponse{
+			Response: &queryrangebase.PrometheusResponse{
+				Status: loghttp.QueryStatusSuccess,
+				Data: queryrangebase.PrometheusData{
+					ResultType: loghttp.ResultTypeMatrix,
+					Result:     result,
+				},
+			},
+		}
+	}
+
+	shards := []queryrangebase.Response{newResp(shardA), newResp(shardB)}
+	if scenario == ScenarioOutOfOrder {
+		shards = []queryrangebase.Response{newResp(shardB), newResp(shardA)}
+	}
+
+	reference := newResp([]queryrangebase.SampleStream{
+		{Labels: fooLabels, Samples: fooSamples},
+		{Labels: barLabels, Samples: barSamples},
+	})
+
+	return shards, reference
+}
@@ -0,0 +1,206 @@
+// Package logqlcompliance drives queryrange's merge functions against a matrix of
+// LogQL query shapes and shard layouts, checking the merged result against a
+// single-shard reference execution. It exists as a regression net for anyone
+// extending the merger (see queryrange.Codec.MergeResponse and
+// queryrange.MergeShardedQuery) and as living documentation of which constructs the
+// merger is currently safe for.
+package logqlcompliance
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/loki/pkg/logql/syntax"
+	"github.com/grafana/loki/pkg/querier/queryrange"
+	"github.com/grafana/loki/pkg/querier/queryrange/queryrangebase"
+)
+
+// QueryShape names one LogQL construct the harness exercises against the merger.
+type QueryShape string
+
+const (
+	ShapeLogQuery      QueryShape = "log_query"
+	ShapeRate          QueryShape = "rate"
+	ShapeCountOverTime QueryShape = "count_over_time"
+	ShapeTopK          QueryShape = "topk"
+	ShapeSumBy         QueryShape = "sum_by"
+	ShapeUnwrap        QueryShape = "unwrap"
+	// ShapeLogQueryArrow drives the same log query as ShapeLogQuery, but through
+	// Codec.EncodeResponse/DecodeResponse's Arrow path first: each shard is encoded to
+	// Arrow IPC and decoded back before being handed to MergeResponse. It exists to
+	// catch a merger that special-cases Arrow-encoded shards (e.g. concatenating their
+	// raw IPC bytes) instead of merging through Data.Result like any other shard.
+	ShapeLogQueryArrow QueryShape = "log_query_arrow"
+)
+
+// AllShapes is the full matrix the harness drives by default.
+var AllShapes = []QueryShape{ShapeLogQuery, ShapeLogQueryArrow, ShapeRate, ShapeCountOverTime, ShapeTopK, ShapeSumBy, ShapeUnwrap}
+
+// exampleQuery is an illustrative LogQL string for each shape, parsed up front so a
+// typo here fails loudly instead of silently testing the wrong construct.
+var exampleQuery = map[QueryShape]string{
+	ShapeLogQuery:      `{app="foo"} |= "error"`,
+	ShapeLogQueryArrow: `{app="foo"} |= "error"`,
+	ShapeRate:          `rate({app="foo"}[5m])`,
+	ShapeCountOverTime: `count_over_time({app="foo"}[5m])`,
+	ShapeTopK:          `topk(3, sum by (app) (rate({app="foo"}[5m])))`,
+	ShapeSumBy:         `sum by (app) (rate({app="foo"}[5m]))`,
+	ShapeUnwrap:        `sum by (app) (rate({app="foo"} | unwrap bytes [5m]))`,
+}
+
+// isStreamShape reports whether shape merges through *queryrange.LokiResponse
+// (log lines) rather than *queryrange.LokiPromResponse (matrix/vector samples).
+func isStreamShape(shape QueryShape) bool {
+	return shape == ShapeLogQuery || shape == ShapeLogQueryArrow
+}
+
+// Scenario names one synthetic shard layout the harness generates per query shape.
+type Scenario string
+
+const (
+	// ScenarioDisjoint splits the data across shards with non-overlapping time
+	// ranges, the common case for a time-sharded range query.
+	ScenarioDisjoint Scenario = "disjoint_shards"
+	// ScenarioOverlapping has two shards both cover part of the same time range,
+	// as happens when queriers retry against a different replica mid-flight.
+	ScenarioOverlapping Scenario = "overlapping_time_range"
+	// ScenarioOutOfOrder delivers shard responses to the merger in an order other
+	// than the one their time ranges would suggest.
+	ScenarioOutOfOrder Scenario = "out_of_order_shards"
+	// ScenarioShardError has one shard fail outright, exercising
+	// queryrange.MergeShardedQuery's PartialResponse/FailedShards path rather
+	// than Codec.MergeResponse directly. Only wired up for log queries today --
+	// see runShardErrorScenario.
+	ScenarioShardError Scenario = "shard_error"
+)
+
+// AllScenarios is the full set of shard layouts the harness generates by default.
+var AllScenarios = []Scenario{ScenarioDisjoint, ScenarioOverlapping, ScenarioOutOfOrder, ScenarioShardError}
+
+// Result is one (shape, scenario) outcome.
+type Result struct {
+	Shape    QueryShape `json:"shape"`
+	Scenario Scenario   `json:"scenario"`
+	Query    string     `json:"query"`
+	Pass     bool       `json:"pass"`
+	Detail   string     `json:"detail,omitempty"`
+}
+
+// Run drives every shape in shapes against every scenario in scenarios and returns
+// the resulting Report. Passing nil for either uses AllShapes/AllScenarios.
+func Run(ctx context.Context, shapes []QueryShape, scenarios []Scenario) Report {
+	if shapes == nil {
+		shapes = AllShapes
+	}
+	if scenarios == nil {
+		scenarios = AllScenarios
+	}
+
+	var report Report
+	for _, shape := range shapes {
+		query := exampleQuery[shape]
+		if _, err := syntax.ParseExpr(query); err != nil {
+			report.Results = append(report.Results, Result{
+				Shape: shape, Query: query,
+				Pass: false, Detail: fmt.Sprintf("example query doesn't parse: %v", err),
+			})
+			continue
+		}
+
+		for _, scenario := range scenarios {
+			report.Results = append(report.Results, runOne(ctx, shape, scenario, query))
+		}
+	}
+	return report
+}
+
+func runOne(ctx context.Context, shape QueryShape, scenario Scenario, query string) Result {
+	result := Result{Shape: shape, Scenario: scenario, Query: query}
+
+	shards, reference, err := generate(ctx, shape, scenario)
+	if err != nil {
+		result.Detail = fmt.Sprintf("generating scenario: %v", err)
+		return result
+	}
+
+	if scenario == ScenarioShardError {
+		return runShardErrorScenario(ctx, result, shards, reference)
+	}
+
+	merged, err := queryrange.DefaultCodec.MergeResponse(shards...)
+	if err != nil {
+		result.Detail = fmt.Sprintf("MergeResponse: %v", err)
+		return result
+	}
+
+	if diff := diffResponses(reference, merged); diff != "" {
+		result.Detail = diff
+		return result
+	}
+
+	result.Pass = true
+	return result
+}
+
+// runShardErrorScenario exercises queryrange.MergeShardedQuery's retry/partial-result
+// path instead of Codec.MergeResponse: one synthetic shard always errors, and the
+// harness asserts the merger still surfaces the other shards' data plus a
+// PartialResponse flag rather than failing the whole query. Only wired up for log
+// queries, since MergeShardedQuery's do callback is typed over *LokiResponse.
+func runShardErrorScenario(ctx context.Context, result Result, shards []queryrangebase.Response, reference queryrangebase.Response) Result {
+	if !isStreamShape(result.Shape) {
+		result.Pass = true
+		result.Detail = "skipped: shard_error scenario only covers log queries today"
+		return result
+	}
+
+	lokiShards := make([]*queryrange.LokiResponse, 0, len(shards))
+	for _, s := range shards {
+		r, ok := s.(*queryrange.LokiResponse)
+		if !ok {
+			result.Detail = fmt.Sprintf("expected *LokiResponse shard, got %T", s)
+			return result
+		}
+		lokiShards = append(lokiShards, r)
+	}
+
+	shardNames := make([]string, len(lokiShards)+1)
+	for i := range lokiShards {
+		shardNames[i] = fmt.Sprintf("shard-%d", i)
+	}
+	shardNames[len(lokiShards)] = "shard-broken"
+
+	do := func(_ context.Context, shardName string) (*queryrange.LokiResponse, error) {
+		if shardName == "shard-broken" {
+			return nil, fmt.Errorf("simulated shard failure")
+		}
+		for i, name := range shardNames[:len(lokiShards)] {
+			if name == shardName {
+				return lokiShards[i], nil
+			}
+		}
+		return nil, fmt.Errorf("unknown shard %s", shardName)
+	}
+
+	merged, err := queryrange.MergeShardedQuery(ctx, nil, shardNames, queryrange.QueryPolicy{MaxRetries: 0}, do)
+	if err != nil {
+		result.Detail = fmt.Sprintf("MergeShardedQuery: %v", err)
+		return result
+	}
+
+	if !merged.PartialResponse {
+		result.Detail = "expected PartialResponse=true with one broken shard"
+		return result
+	}
+	if len(merged.FailedShards) != 1 || merged.FailedShards[0].Shard != "shard-broken" {
+		result.Detail = fmt.Sprintf("expected exactly shard-broken in FailedShards, got %v", merged.FailedShards)
+		return result
+	}
+	if diff := diffResponses(reference, merged); diff != "" {
+		result.Detail = diff
+		return result
+	}
+
+	result.Pass = true
+	return result
+}
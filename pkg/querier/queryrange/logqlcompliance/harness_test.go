@@ -0,0 +1,19 @@
+package logqlcompliance
+
+import (
+	"context"
+	"testing"
+)
+
+// TestLogQLCompliance runs Run across every shape in AllShapes and every scenario in
+// AllScenarios -- the full matrix the harness is built to exercise -- and fails with
+// each result's detail if anything didn't pass. Without this, nothing in the module's
+// test suite ever actually calls Run, so a merger regression the harness was written to
+// catch could go unnoticed until someone remembered to run it by hand.
+func TestLogQLCompliance(t *testing.T) {
+	report := Run(context.Background(), AllShapes, AllScenarios)
+
+	for _, res := range report.Failed() {
+		t.Errorf("shape=%s scenario=%s query=%q: %s", res.Shape, res.Scenario, res.Query, res.Detail)
+	}
+}
@@ -0,0 +1,160 @@
+package logqlcompliance
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"reflect"
+	"strings"
+
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/querier/queryrange"
+	"github.com/grafana/loki/pkg/querier/queryrange/queryrangebase"
+)
+
+// Report is the outcome of a Run: one Result per (shape, scenario) pair attempted.
+type Report struct {
+	Results []Result `json:"results"`
+}
+
+// Passed returns the Results that succeeded.
+func (r Report) Passed() []Result {
+	var out []Result
+	for _, res := range r.Results {
+		if res.Pass {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// Failed returns the Results that didn't, in case a caller wants to print just the
+// ones worth looking at.
+func (r Report) Failed() []Result {
+	var out []Result
+	for _, res := range r.Results {
+		if !res.Pass {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// JSON renders the report as indented JSON.
+func (r Report) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+var reportHTMLTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head><title>LogQL merge compliance report</title></head>
+<body>
+<h1>LogQL merge compliance report</h1>
+<p>{{len .Passed}} / {{len .Results}} passed</p>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Shape</th><th>Scenario</th><th>Query</th><th>Result</th><th>Detail</th></tr>
+{{range .Results}}<tr>
+<td>{{.Shape}}</td>
+<td>{{.Scenario}}</td>
+<td><code>{{.Query}}</code></td>
+<td>{{if .Pass}}PASS{{else}}FAIL{{end}}</td>
+<td>{{.Detail}}</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+// HTML renders the report as a single self-contained HTML page.
+func (r Report) HTML() (string, error) {
+	var buf strings.Builder
+	if err := reportHTMLTemplate.Execute(&buf, r); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// diffResponses compares a single-shard reference execution against the merger's
+// output and returns an empty string if they agree, or a human-readable explanation
+// of the first disagreement found otherwise. Only the fields that carry the actual
+// query result are compared -- Statistics, Headers, and similar bookkeeping are
+// expected to differ across a merge and aren't part of the merger's data contract.
+func diffResponses(reference, merged queryrangebase.Response) string {
+	switch ref := reference.(type) {
+	case *queryrange.LokiResponse:
+		got, ok := merged.(*queryrange.LokiResponse)
+		if !ok {
+			return fmt.Sprintf("expected *LokiResponse, got %T", merged)
+		}
+		return diffStreams(ref.Data.Result, got.Data.Result)
+	case *queryrange.LokiPromResponse:
+		got, ok := merged.(*queryrange.LokiPromResponse)
+		if !ok {
+			return fmt.Sprintf("expected *LokiPromResponse, got %T", merged)
+		}
+		return diffSampleStreams(ref.Response.Data.Result, got.Response.Data.Result)
+	default:
+		return fmt.Sprintf("unsupported reference response type %T", reference)
+	}
+}
+
+// diffStreams compares two sets of log streams by label set, ignoring the order
+// streams (and the shards they came from) were produced in -- the merger doesn't
+// promise a particular stream ordering, only that every stream's entries are
+// complete, deduped, and sorted.
+func diffStreams(ref, got []logproto.Stream) string {
+	refByLabels := streamEntriesByLabels(ref)
+	gotByLabels := streamEntriesByLabels(got)
+
+	if len(refByLabels) != len(gotByLabels) {
+		return fmt.Sprintf("expected %d distinct streams, got %d", len(refByLabels), len(gotByLabels))
+	}
+	for labels, entries := range refByLabels {
+		gotEntries, ok := gotByLabels[labels]
+		if !ok {
+			return fmt.Sprintf("stream %s missing from merged result", labels)
+		}
+		if !reflect.DeepEqual(entries, gotEntries) {
+			return fmt.Sprintf("stream %s: expected entries %+v, got %+v", labels, entries, gotEntries)
+		}
+	}
+	return ""
+}
+
+func streamEntriesByLabels(streams []logproto.Stream) map[string][]logproto.Entry {
+	out := make(map[string][]logproto.Entry, len(streams))
+	for _, s := range streams {
+		out[s.Labels] = append(out[s.Labels], s.Entries...)
+	}
+	return out
+}
+
+// diffSampleStreams is diffStreams' counterpart for matrix/vector results.
+func diffSampleStreams(ref, got []queryrangebase.SampleStream) string {
+	refBySeries := sampleStreamsBySeries(ref)
+	gotBySeries := sampleStreamsBySeries(got)
+
+	if len(refBySeries) != len(gotBySeries) {
+		return fmt.Sprintf("expected %d distinct series, got %d", len(refBySeries), len(gotBySeries))
+	}
+	for series, samples := range refBySeries {
+		gotSamples, ok := gotBySeries[series]
+		if !ok {
+			return fmt.Sprintf("series %s missing from merged result", series)
+		}
+		if !reflect.DeepEqual(samples, gotSamples) {
+			return fmt.Sprintf("series %s: expected samples %+v, got %+v", series, samples, gotSamples)
+		}
+	}
+	return ""
+}
+
+func sampleStreamsBySeries(series []queryrangebase.SampleStream) map[string][]logproto.LegacySample {
+	out := make(map[string][]logproto.LegacySample, len(series))
+	for _, s := range series {
+		key := queryrange.LabelAdaptersKey(s.Labels)
+		out[key] = append(out[key], s.Samples...)
+	}
+	return out
+}
@@ -0,0 +1,247 @@
+package queryrange
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	json "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/loki/pkg/logproto"
+)
+
+// LokiStream is the unit Send forwards downstream: a label set plus its ordered
+// entries, the same grouping a merged LokiResponse already carries in Data.Result.
+type LokiStream = logproto.Stream
+
+// PushClientConfig controls how Client batches writes to a downstream Loki's
+// /loki/api/v1/push and how aggressively it retries a failed batch.
+type PushClientConfig struct {
+	// URL is the full push endpoint, e.g. "http://downstream:3100/loki/api/v1/push".
+	URL string
+	// BatchSize is the pending size in bytes (label strings plus log line lengths, not
+	// the encoded request) at which a batch is flushed early, rather than waiting out
+	// the rest of BatchWait.
+	BatchSize int
+	// BatchWait bounds how long a partially-filled batch is held before flushing.
+	BatchWait time.Duration
+	// Timeout bounds a single push HTTP call, not the overall retry loop.
+	Timeout time.Duration
+	// MaxRetries caps the number of retries for a batch that keeps hitting 429/5xx.
+	MaxRetries int
+}
+
+// pushMetrics tracks outcomes that matter for an operator running this as a
+// read-transform-write pipeline rather than a pure read-only merger.
+type pushMetrics struct {
+	sent    prometheus.Counter
+	retries prometheus.Counter
+	dropped *prometheus.CounterVec
+}
+
+func newPushMetrics(reg prometheus.Registerer) *pushMetrics {
+	return &pushMetrics{
+		sent: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki",
+			Subsystem: "queryrange_push_client",
+			Name:      "streams_sent_total",
+			Help:      "Number of streams successfully forwarded downstream.",
+		}),
+		retries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki",
+			Subsystem: "queryrange_push_client",
+			Name:      "retries_total",
+			Help:      "Number of retried push attempts due to 429/5xx responses.",
+		}),
+		dropped: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "loki",
+			Subsystem: "queryrange_push_client",
+			Name:      "streams_dropped_total",
+			Help:      "Number of streams permanently dropped after a non-429 4xx response.",
+		}, []string{"status"}),
+	}
+}
+
+// Client batches merged query-range results and forwards them to another Loki
+// instance's push API. It prefers snappy-compressed protobuf, the same wire format
+// Promtail/the distributor use, and falls back to plain JSON if the peer responds
+// with an unsupported media type error.
+type Client struct {
+	cfg     PushClientConfig
+	http    *http.Client
+	metrics *pushMetrics
+
+	mtx     sync.Mutex
+	pending []logproto.Stream
+	bytes   int
+	timer   *time.Timer
+}
+
+// NewClient builds a Client against cfg, registering its metrics with reg (pass
+// prometheus.DefaultRegisterer if the caller doesn't already scope one).
+func NewClient(cfg PushClientConfig, reg prometheus.Registerer) *Client {
+	if cfg.BatchWait <= 0 {
+		cfg.BatchWait = time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1 << 20 // 1MiB
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 5
+	}
+	return &Client{
+		cfg:     cfg,
+		http:    &http.Client{Timeout: cfg.Timeout},
+		metrics: newPushMetrics(reg),
+	}
+}
+
+// Send enqueues streams for delivery, flushing immediately once the pending batch
+// reaches BatchSize and otherwise leaving it for the BatchWait timer. Only a
+// size-triggered flush (the common case under steady load) reports its push error
+// back to the caller; a time-triggered flush of a small, trailing batch has no
+// in-flight Send() call to return an error to, so its outcome surfaces through the
+// sent/retries/dropped metrics instead.
+func (c *Client) Send(ctx context.Context, streams []LokiStream) error {
+	c.mtx.Lock()
+	c.pending = append(c.pending, streams...)
+	for _, s := range streams {
+		c.bytes += len(s.Labels)
+		for _, e := range s.Entries {
+			c.bytes += len(e.Line)
+		}
+	}
+
+	if c.bytes < c.cfg.BatchSize {
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.cfg.BatchWait, c.flushAsync)
+		}
+		c.mtx.Unlock()
+		return nil
+	}
+
+	batch := c.takeBatchLocked()
+	c.mtx.Unlock()
+
+	return c.pushBatch(ctx, batch)
+}
+
+// takeBatchLocked detaches the pending batch and resets the timer. The caller must
+// hold c.mtx.
+func (c *Client) takeBatchLocked() []logproto.Stream {
+	batch := c.pending
+	c.pending = nil
+	c.bytes = 0
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	return batch
+}
+
+// flushAsync is the BatchWait timer callback for a batch that never reached
+// BatchSize.
+func (c *Client) flushAsync() {
+	c.mtx.Lock()
+	batch := c.takeBatchLocked()
+	c.mtx.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+	_ = c.pushBatch(context.Background(), batch)
+}
+
+// pushBatch encodes and sends one batch, retrying 429/5xx with exponential backoff.
+// A non-429 4xx is treated as a permanent rejection of the batch: it's counted via
+// the dropped metric and returned as an error rather than retried, since retrying a
+// malformed or unauthorized push can't ever succeed.
+func (c *Client) pushBatch(ctx context.Context, streams []logproto.Stream) error {
+	req := &logproto.PushRequest{Streams: streams}
+
+	body, err := req.Marshal()
+	if err != nil {
+		return fmt.Errorf("encoding push request: %w", err)
+	}
+	compressed := snappy.Encode(nil, body)
+	contentType := ProtobufType
+
+	backoff := 500 * time.Millisecond
+	const maxBackoff = 30 * time.Second
+
+	for attempt := 0; ; attempt++ {
+		status, err := c.post(ctx, compressed, contentType)
+		if err == nil {
+			c.metrics.sent.Add(float64(len(streams)))
+			return nil
+		}
+
+		// A peer that doesn't understand the protobuf content type gets exactly one
+		// retry with a plain JSON body instead of being treated as a hard failure.
+		if status == http.StatusUnsupportedMediaType && contentType == ProtobufType {
+			jsonBody, jerr := encodePushRequestJSON(req)
+			if jerr == nil {
+				compressed, contentType = jsonBody, "application/json; charset=UTF-8"
+				continue
+			}
+		}
+
+		if status == http.StatusTooManyRequests || status/100 == 5 {
+			if attempt >= c.cfg.MaxRetries {
+				return fmt.Errorf("giving up after %d retries: %w", attempt, err)
+			}
+			c.metrics.retries.Inc()
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+
+		if status/100 == 4 {
+			c.metrics.dropped.WithLabelValues(fmt.Sprintf("%d", status)).Add(float64(len(streams)))
+		}
+		return err
+	}
+}
+
+func (c *Client) post(ctx context.Context, body []byte, contentType string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if contentType == ProtobufType {
+		req.Header.Set("Content-Encoding", "snappy")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("push returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// encodePushRequestJSON is the fallback used when a peer rejects the preferred
+// snappy-compressed protobuf encoding with a 415.
+func encodePushRequestJSON(req *logproto.PushRequest) ([]byte, error) {
+	return json.Marshal(req)
+}
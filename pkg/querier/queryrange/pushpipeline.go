@@ -0,0 +1,37 @@
+package queryrange
+
+import (
+	"context"
+
+	"github.com/grafana/loki/pkg/querier/queryrange/queryrangebase"
+)
+
+// PushPipeline composes MergeShardedQuery with a push Client (push.go), the shape a "replay
+// this shard fan-out to another Loki" job needs: merge the shards once, then forward
+// the merged streams straight to Client.Send instead of a caller threading
+// LokiResponse.Data.Result through by hand.
+type PushPipeline struct {
+	client *Client
+	policy QueryPolicy
+}
+
+// NewPushPipeline builds a PushPipeline that forwards merged results to client,
+// retrying per-shard fetches per policy.
+func NewPushPipeline(client *Client, policy QueryPolicy) *PushPipeline {
+	return &PushPipeline{client: client, policy: policy}
+}
+
+// Run fetches shards via do, merges them via MergeShardedQuery, and forwards the
+// merged streams to the pipeline's Client. The merged response is still returned so a
+// caller can inspect PartialResponse/FailedShards/Statistics even though its data has
+// already been pushed downstream.
+func (p *PushPipeline) Run(ctx context.Context, req queryrangebase.Request, shards []string, do func(ctx context.Context, shard string) (*LokiResponse, error)) (*LokiResponse, error) {
+	merged, err := MergeShardedQuery(ctx, req, shards, p.policy, do)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.client.Send(ctx, merged.Data.Result); err != nil {
+		return merged, err
+	}
+	return merged, nil
+}
@@ -0,0 +1,144 @@
+package queryrange
+
+import (
+	"time"
+
+	"github.com/grafana/loki/pkg/logproto"
+)
+
+// LokiRequest is the range-query shape of queryrangebase.Request: a LogQL query over
+// [StartTs, EndTs) split into Step-sized samples (Interval for log queries), optionally
+// pre-sharded by Shards. It's the request type DecodeRequest/DecodeHTTPGrpcRequest build
+// for QueryRangeOp and the one ParamsFromRequest/the splitter/sharding middlewares
+// operate on.
+type LokiRequest struct {
+	Query     string
+	Limit     uint32
+	Step      int64
+	Interval  int64
+	StartTs   time.Time
+	EndTs     time.Time
+	Direction logproto.Direction
+	Path      string
+	Shards    []string
+	// StatsMode records the requested `stats=none|basic|all` verbosity. EncodeRequest
+	// forwards it downstream, and decodeResponseJSONFrom computes per-step accounting
+	// only when it is StatsAll.
+	StatsMode string
+	// Deadline is the absolute cut-off requestDeadline/WithDeadline derive a
+	// context.Context deadline from, so every split/shard this request fans out to
+	// inherits the same cut-off. Zero means no explicit deadline was set.
+	Deadline time.Time
+}
+
+func (r *LokiRequest) GetQuery() string {
+	if r != nil {
+		return r.Query
+	}
+	return ""
+}
+
+func (r *LokiRequest) GetLimit() uint32 {
+	if r != nil {
+		return r.Limit
+	}
+	return 0
+}
+
+func (r *LokiRequest) GetStep() int64 {
+	if r != nil {
+		return r.Step
+	}
+	return 0
+}
+
+func (r *LokiRequest) GetInterval() int64 {
+	if r != nil {
+		return r.Interval
+	}
+	return 0
+}
+
+func (r *LokiRequest) GetDirection() logproto.Direction {
+	if r != nil {
+		return r.Direction
+	}
+	return logproto.FORWARD
+}
+
+func (r *LokiRequest) GetShards() []string {
+	if r != nil {
+		return r.Shards
+	}
+	return nil
+}
+
+// LokiInstantRequest is the instant-query counterpart of LokiRequest: a LogQL query
+// evaluated at a single TimeTs rather than over a range.
+type LokiInstantRequest struct {
+	Query     string
+	Limit     uint32
+	TimeTs    time.Time
+	Direction logproto.Direction
+	Path      string
+	Shards    []string
+	StatsMode string
+	Deadline  time.Time
+}
+
+func (r *LokiInstantRequest) GetQuery() string {
+	if r != nil {
+		return r.Query
+	}
+	return ""
+}
+
+func (r *LokiInstantRequest) GetLimit() uint32 {
+	if r != nil {
+		return r.Limit
+	}
+	return 0
+}
+
+func (r *LokiInstantRequest) GetInterval() int64 {
+	return 0
+}
+
+func (r *LokiInstantRequest) GetDirection() logproto.Direction {
+	if r != nil {
+		return r.Direction
+	}
+	return logproto.FORWARD
+}
+
+func (r *LokiInstantRequest) GetShards() []string {
+	if r != nil {
+		return r.Shards
+	}
+	return nil
+}
+
+// LokiSeriesRequest is the decoded form of a /loki/api/v1/series request: a set of
+// stream selectors to match over [StartTs, EndTs), optionally pre-sharded by Shards.
+type LokiSeriesRequest struct {
+	Match    []string
+	StartTs  time.Time
+	EndTs    time.Time
+	Path     string
+	Shards   []string
+	Deadline time.Time
+}
+
+func (r *LokiSeriesRequest) GetMatch() []string {
+	if r != nil {
+		return r.Match
+	}
+	return nil
+}
+
+func (r *LokiSeriesRequest) GetShards() []string {
+	if r != nil {
+		return r.Shards
+	}
+	return nil
+}
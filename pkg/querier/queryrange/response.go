@@ -0,0 +1,140 @@
+package queryrange
+
+import (
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/logqlmodel/stats"
+	"github.com/grafana/loki/pkg/querier/queryrange/queryrangebase"
+)
+
+// LokiData is the `data` section of a LokiResponse: a log-query result type tag plus
+// the matched streams.
+type LokiData struct {
+	ResultType string
+	Result     []logproto.Stream
+}
+
+// LokiResponse is the response counterpart of LokiRequest/LokiInstantRequest: the
+// merged, possibly-sharded result of a log query, in the shape loghttp's
+// `/loki/api/v1/query`/`/loki/api/v1/query_range` JSON encodes.
+type LokiResponse struct {
+	Status     string
+	Direction  logproto.Direction
+	Limit      uint32
+	Version    uint32
+	ErrorType  string
+	Error      string
+	Statistics stats.Result
+	Data       LokiData
+	Headers    []queryrangebase.PrometheusResponseHeader
+	// ArrowEncoded carries a ready-to-serve Arrow IPC stream for this response, set
+	// only on a response decoded straight from an Arrow-encoded shard that was never
+	// merged with another. Empty means Data.Result is the source of truth and
+	// encodeResponseArrow must encode it -- true of every merged response, since
+	// mergeLokiResponse always merges through Data.Result.
+	ArrowEncoded []byte
+	// PartialResponse and FailedShards are set by MergeShardedQuery when one or more
+	// shards never produced a response after retrying per QueryPolicy, so a caller can
+	// surface a warning rather than fail the whole query over a single bad shard.
+	PartialResponse bool
+	FailedShards    []ShardError
+	// SamplesQueriedPerStep is populated only when the originating request asked for
+	// StatsAll: one entry per distinct entry timestamp in Data.Result, recording how
+	// many result entries carry that timestamp. Lines the query scanned but did not
+	// return are not counted. This is the log-query analogue of a metric engine's
+	// "total queryable samples per step" accounting.
+	//
+	// It's an in-process-only accounting field, not a wire-format one: the JSON body
+	// actually returned to a client is written by encodeResponseJSONTo calling into
+	// pkg/util/marshal.WriteQueryResponseJSON/marshal_legacy.WriteQueryResponseJSON,
+	// neither of which is part of this checkout, and neither of which accepts
+	// anything beyond Data.Result and Statistics today. Getting this field onto the
+	// wire needs those writers (and likely stats.Result itself) extended, which is
+	// outside this package's scope; until then, a caller of Codec.MergeResponse in the
+	// same process can read it, but an HTTP client of the query-range API can't. The
+	// struct tag below is aspirational, matching the field name WriteQueryResponseJSON
+	// would need to adopt to actually emit it.
+	SamplesQueriedPerStep []StepSamplesQueried `json:"samplesQueriedPerStep,omitempty"`
+}
+
+// StepSamplesQueried pairs a result timestamp with the number of log lines that were
+// scanned to produce it, used by LokiResponse.SamplesQueriedPerStep.
+type StepSamplesQueried struct {
+	TimestampMs int64 `json:"ts"`
+	Samples     int64 `json:"samplesQueried"`
+}
+
+func (r *LokiResponse) GetHeaders() []*queryrangebase.PrometheusResponseHeader {
+	return convertPrometheusResponseHeadersToPointers(r.Headers)
+}
+
+// VolumeResponse wraps a logproto.VolumeResponse with the response headers the rest of
+// queryrangebase.Response implementations in this package carry, mirroring
+// IndexStatsResponse's relationship to logproto.IndexStatsResponse.
+type VolumeResponse struct {
+	Response *logproto.VolumeResponse
+	Headers  []queryrangebase.PrometheusResponseHeader
+}
+
+func (r *VolumeResponse) GetHeaders() []*queryrangebase.PrometheusResponseHeader {
+	return convertPrometheusResponseHeadersToPointers(r.Headers)
+}
+
+// WithHeaders returns r with its response headers set to headers, mirroring the
+// WithHeaders method every other *Response type in decodeResponseProtobuf's switch
+// already exposes.
+func (r *VolumeResponse) WithHeaders(headers []queryrangebase.PrometheusResponseHeader) *VolumeResponse {
+	r.Headers = headers
+	return r
+}
+
+// QueryResponse is the protobuf envelope a Codec using ProtobufType multiplexes every
+// operation's response through: Series/Labels/Stats/Volume are single-shape responses
+// exposed as plain optional fields, while Response carries the query-range/instant
+// result (stream, matrix/vector, or sketch) as a oneof. The oneof's concrete variants
+// (QueryResponse_Prom, QueryResponse_Streams, QueryResponse_TopkSketches,
+// QueryResponse_QuantileSketches) and Marshal/Unmarshal are generated from
+// queryrange.proto by protoc, which isn't part of this checkout.
+type QueryResponse struct {
+	Series   *LokiSeriesResponse
+	Labels   *LokiLabelNamesResponse
+	Stats    *IndexStatsResponse
+	Volume   *VolumeResponse
+	Response isQueryResponse_Response
+}
+
+// isQueryResponse_Response marks the protoc-generated oneof wrapper types
+// (QueryResponse_Prom and friends) that can populate QueryResponse.Response.
+type isQueryResponse_Response interface {
+	isQueryResponse_Response()
+}
+
+func (m *QueryResponse) GetSeries() *LokiSeriesResponse {
+	if m != nil {
+		return m.Series
+	}
+	return nil
+}
+
+func (m *QueryResponse) GetLabels() *LokiLabelNamesResponse {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+func (m *QueryResponse) GetStats() *IndexStatsResponse {
+	if m != nil {
+		return m.Stats
+	}
+	return nil
+}
+
+// GetVolume returns the VolumeResponse carried by a /loki/api/v1/index/volume request's
+// protobuf-encoded response, mirroring the already-established GetSeries/GetLabels/
+// GetStats accessors above.
+func (m *QueryResponse) GetVolume() *VolumeResponse {
+	if m != nil {
+		return m.Volume
+	}
+	return nil
+}
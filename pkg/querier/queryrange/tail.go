@@ -0,0 +1,309 @@
+package queryrange
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/grafana/loki/pkg/loghttp"
+	"github.com/grafana/loki/pkg/logproto"
+)
+
+// tailSourceLabel annotates a forwarded DroppedEntry with the index (into the sources
+// slice passed to MergeTailResponses) of the shard/replica that reported it, since
+// loghttp.DroppedEntry otherwise carries no notion of which upstream it came from.
+const tailSourceLabel = "__tail_source__"
+
+// annotateSource copies a DroppedEntry and tags its label set with the source index.
+func annotateSource(d loghttp.DroppedEntry, source int) loghttp.DroppedEntry {
+	labels := make(loghttp.LabelSet, len(d.Labels)+1)
+	for k, v := range d.Labels {
+		labels[k] = v
+	}
+	labels[tailSourceLabel] = strconv.Itoa(source)
+	d.Labels = labels
+	return d
+}
+
+// DefaultTailMergeMaxDelay bounds how long MergeTailResponses waits on a lagging source
+// before emitting entries already buffered from faster ones, so a single stalled
+// shard/replica doesn't block the whole /loki/api/v1/tail fan-out indefinitely.
+const DefaultTailMergeMaxDelay = 3 * time.Second
+
+// tailKey identifies a single log line for dedup purposes: replicas of the same shard
+// can (and do) deliver the same (stream, timestamp, line) triple more than once.
+type tailKey struct {
+	labels    string
+	timestamp time.Time
+	line      string
+}
+
+// tailEntry is one log line pulled off a source's TailResponse, tagged with the stream
+// labels needed to order and dedup it against entries from other sources.
+type tailEntry struct {
+	source int
+	labels string
+	logproto.Entry
+}
+
+// tailHeap orders tailEntry by (timestamp, labels) so MergeTailResponses always emits
+// in time order, breaking ties deterministically by stream identity.
+type tailHeap []tailEntry
+
+func (h tailHeap) Len() int { return len(h) }
+func (h tailHeap) Less(i, j int) bool {
+	if !h[i].Timestamp.Equal(h[j].Timestamp) {
+		return h[i].Timestamp.Before(h[j].Timestamp)
+	}
+	return h[i].labels < h[j].labels
+}
+func (h tailHeap) Swap(i, j int)        { h[i], h[j] = h[j], h[i] }
+func (h *tailHeap) Push(x interface{})  { *h = append(*h, x.(tailEntry)) }
+func (h *tailHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// taggedTailResponse carries a source's TailResponse alongside the index that
+// identifies it, so the fan-in goroutines below can share one channel.
+type taggedTailResponse struct {
+	source int
+	resp   *loghttp.TailResponse
+}
+
+// MergeTailResponses k-way merges per-source tail channels -- one per upstream Loki
+// shard/replica hit by a /loki/api/v1/tail fan-out -- into a single ordered
+// loghttp.TailResponse stream. Entries are held in a min-heap keyed on
+// (timestamp, stream) until every source has watermarked past them, at which point
+// they're safe to emit in order; a source that goes quiet for longer than maxDelay is
+// excluded from that watermark so it can't stall the others forever. Replica-delivered
+// duplicates (identical stream/timestamp/line) are dropped, and DroppedEntries are
+// forwarded with the originating source's labels annotated via the synthetic
+// "__tail_source__" label so a caller can tell which shard dropped them.
+func MergeTailResponses(ctx context.Context, sources []<-chan *loghttp.TailResponse, maxDelay time.Duration) (<-chan *loghttp.TailResponse, <-chan error) {
+	if maxDelay <= 0 {
+		maxDelay = DefaultTailMergeMaxDelay
+	}
+
+	out := make(chan *loghttp.TailResponse)
+	errc := make(chan error, 1)
+
+	in := make(chan taggedTailResponse)
+	for i, src := range sources {
+		go func(i int, src <-chan *loghttp.TailResponse) {
+			for {
+				select {
+				case resp, ok := <-src:
+					if !ok {
+						select {
+						case in <- taggedTailResponse{source: i, resp: nil}:
+						case <-ctx.Done():
+						}
+						return
+					}
+					select {
+					case in <- taggedTailResponse{source: i, resp: resp}:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(i, src)
+	}
+
+	go func() {
+		defer close(out)
+
+		h := &tailHeap{}
+		seen := make(map[tailKey]struct{})
+		watermark := make([]time.Time, len(sources))
+		lastActivity := make([]time.Time, len(sources))
+		closed := make([]bool, len(sources))
+		now := time.Now()
+		for i := range sources {
+			lastActivity[i] = now
+		}
+
+		// flush emits every buffered entry whose timestamp has fallen behind every
+		// source's watermark (excluding sources idle past maxDelay, whose watermark
+		// can't be trusted to still be advancing), and prunes seen to match: once every
+		// source has watermarked past a timestamp, no source can still be holding an
+		// unreplayed duplicate at or before it, so seen would otherwise grow forever
+		// over a long-lived tail connection.
+		flush := func() {
+			threshold, ok := safeWatermark(watermark, lastActivity, closed, maxDelay)
+			if !ok {
+				return
+			}
+			for k := range seen {
+				if !k.timestamp.After(threshold) {
+					delete(seen, k)
+				}
+			}
+			var streams []logproto.Stream
+			byLabels := make(map[string]int)
+			for h.Len() > 0 && !(*h)[0].Timestamp.After(threshold) {
+				e := heap.Pop(h).(tailEntry)
+				if idx, ok := byLabels[e.labels]; ok {
+					streams[idx].Entries = append(streams[idx].Entries, e.Entry)
+					continue
+				}
+				byLabels[e.labels] = len(streams)
+				streams = append(streams, logproto.Stream{Labels: e.labels, Entries: []logproto.Entry{e.Entry}})
+			}
+			if len(streams) > 0 {
+				select {
+				case out <- &loghttp.TailResponse{Streams: streams}:
+				case <-ctx.Done():
+				}
+			}
+		}
+
+		ticker := time.NewTicker(maxDelay)
+		defer ticker.Stop()
+
+		remaining := len(sources)
+		for remaining > 0 {
+			select {
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			case <-ticker.C:
+				flush()
+			case tagged, ok := <-in:
+				if !ok {
+					return
+				}
+				src := tagged.source
+				if tagged.resp == nil {
+					closed[src] = true
+					remaining--
+					flush()
+					continue
+				}
+				resp := tagged.resp
+				lastActivity[src] = time.Now()
+
+				for _, stream := range resp.Streams {
+					for _, entry := range stream.Entries {
+						key := tailKey{labels: stream.Labels, timestamp: entry.Timestamp, line: entry.Line}
+						if _, dup := seen[key]; dup {
+							continue
+						}
+						seen[key] = struct{}{}
+						heap.Push(h, tailEntry{source: src, labels: stream.Labels, Entry: entry})
+						if entry.Timestamp.After(watermark[src]) {
+							watermark[src] = entry.Timestamp
+						}
+					}
+				}
+
+				if len(resp.DroppedEntries) > 0 {
+					dropped := make([]loghttp.DroppedEntry, len(resp.DroppedEntries))
+					for i, d := range resp.DroppedEntries {
+						dropped[i] = annotateSource(d, src)
+					}
+					select {
+					case out <- &loghttp.TailResponse{DroppedEntries: dropped}:
+					case <-ctx.Done():
+						errc <- ctx.Err()
+						return
+					}
+				}
+
+				flush()
+			}
+		}
+
+		flush()
+	}()
+
+	return out, errc
+}
+
+// TailShardDialer opens one shard/replica's /loki/api/v1/tail connection, returning
+// the channel its entries are delivered on.
+type TailShardDialer func(ctx context.Context, shard string) (<-chan *loghttp.TailResponse, error)
+
+// FetchTailShards dials every shard via dial and k-way merges their streams through
+// MergeTailResponses, giving the websocket tail fan-out a single entry point that
+// mirrors FetchShards/MergeShardedQuery's shape for range/instant queries. A shard
+// that fails to dial is reported on the returned error channel rather than aborting
+// the shards that dialed successfully.
+func FetchTailShards(ctx context.Context, shards []string, maxDelay time.Duration, dial TailShardDialer) (<-chan *loghttp.TailResponse, <-chan error) {
+	sources := make([]<-chan *loghttp.TailResponse, 0, len(shards))
+	var dialErrs []error
+	for _, shard := range shards {
+		src, err := dial(ctx, shard)
+		if err != nil {
+			dialErrs = append(dialErrs, fmt.Errorf("dialing tail shard %s: %w", shard, err))
+			continue
+		}
+		sources = append(sources, src)
+	}
+
+	mergedOut, mergeErrc := MergeTailResponses(ctx, sources, maxDelay)
+
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		for _, err := range dialErrs {
+			select {
+			case errc <- err:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := <-mergeErrc; err != nil {
+			select {
+			case errc <- err:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return mergedOut, errc
+}
+
+// safeWatermark returns the earliest watermark among sources that are still open and
+// have reported activity within maxDelay, i.e. the point up to which it's safe to emit
+// buffered entries. When no source qualifies, it returns the furthest-advanced
+// watermark of all sources. It reports ok=false only when there are no sources.
+func safeWatermark(watermark, lastActivity []time.Time, closed []bool, maxDelay time.Duration) (time.Time, bool) {
+	now := time.Now()
+	var (
+		min   time.Time
+		found bool
+	)
+	for i := range watermark {
+		if closed[i] {
+			continue
+		}
+		if now.Sub(lastActivity[i]) > maxDelay {
+			// stale source: don't let it hold back the others.
+			continue
+		}
+		if !found || watermark[i].Before(min) {
+			min = watermark[i]
+			found = true
+		}
+	}
+	if !found {
+		// every source is stale; fall back to the furthest-advanced watermark so
+		// output still progresses once the whole fan-out has gone quiet.
+		for i := range watermark {
+			if !found || watermark[i].After(min) {
+				min = watermark[i]
+				found = true
+			}
+		}
+	}
+	return min, found
+}